@@ -0,0 +1,154 @@
+// Copyright (C) 2018 go-nebulas authors
+//
+// This file is part of the go-nebulas library.
+//
+// the go-nebulas library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// the go-nebulas library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with the go-nebulas library.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package net
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	"github.com/nebulasio/go-nebulas/util/logging"
+	"github.com/sirupsen/logrus"
+)
+
+// BackoffConfig controls the exponential-backoff-with-jitter reconnect policy applied to a peer
+// whose stream keeps failing, modeled on the gRPC connection-backoff spec.
+type BackoffConfig struct {
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+	Multiplier float64
+	Jitter     float64
+}
+
+// DefaultBackoffConfig returns the gRPC-spec defaults used when Config.Backoff is left unset.
+func DefaultBackoffConfig() *BackoffConfig {
+	return &BackoffConfig{
+		BaseDelay:  time.Second,
+		MaxDelay:   120 * time.Second,
+		Multiplier: 1.6,
+		Jitter:     0.2,
+	}
+}
+
+// delay computes delay = min(MaxDelay, BaseDelay * Multiplier^retries) * (1 +/- Jitter).
+func (c *BackoffConfig) delay(retries int) time.Duration {
+	backoff := float64(c.BaseDelay) * math.Pow(c.Multiplier, float64(retries))
+	if max := float64(c.MaxDelay); backoff > max {
+		backoff = max
+	}
+	jitter := 1 + c.Jitter*(2*rand.Float64()-1)
+	return time.Duration(backoff * jitter)
+}
+
+// peerBackoff is the consecutive-failure state tracked for a single peer.ID.
+type peerBackoff struct {
+	retries      int
+	blockedUntil time.Time
+}
+
+// backoffTracker is a per-Node registry of peerBackoff state, consulted by Stream.Connect and
+// updated from Stream.close and Stream.finishHandshake.
+type backoffTracker struct {
+	mutex sync.Mutex
+	cfg   *BackoffConfig
+	peers map[peer.ID]*peerBackoff
+}
+
+func newBackoffTracker(cfg *BackoffConfig) *backoffTracker {
+	if cfg == nil {
+		cfg = DefaultBackoffConfig()
+	}
+	return &backoffTracker{cfg: cfg, peers: make(map[peer.ID]*peerBackoff)}
+}
+
+// backoffTrackers holds one backoffTracker per Node, mirroring the relayLimiters registry in
+// relay.go so per-peer retry state doesn't need a new field threaded through Node itself.
+var backoffTrackers sync.Map // map[*Node]*backoffTracker
+
+func backoffTrackerFor(node *Node) *backoffTracker {
+	v, _ := backoffTrackers.LoadOrStore(node, newBackoffTracker(node.config.Backoff))
+	return v.(*backoffTracker)
+}
+
+// allowDial reports whether pid may be dialed right now, given its failure history.
+func (t *backoffTracker) allowDial(pid peer.ID) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	state, ok := t.peers[pid]
+	return !ok || !time.Now().Before(state.blockedUntil)
+}
+
+// recordFailure bumps pid's consecutive-failure count and schedules its next allowed dial time.
+func (t *backoffTracker) recordFailure(pid peer.ID) {
+	t.mutex.Lock()
+	state, ok := t.peers[pid]
+	if !ok {
+		state = &peerBackoff{}
+		t.peers[pid] = state
+	}
+	delay := t.cfg.delay(state.retries)
+	state.blockedUntil = time.Now().Add(delay)
+	state.retries++
+	retries := state.retries
+	t.mutex.Unlock()
+
+	logging.VLog().WithFields(logrus.Fields{
+		"pid":     pid.Pretty(),
+		"retries": retries,
+		"delay":   delay,
+	}).Debug("Peer stream failed, applying reconnect backoff.")
+}
+
+// recordSuccess resets pid's consecutive-failure count after a successful handshake.
+func (t *backoffTracker) recordSuccess(pid peer.ID) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.peers, pid)
+}
+
+// Retries reports pid's current consecutive-failure count. Nothing in this package calls it or
+// registers it with the metrics registry.
+func (t *backoffTracker) Retries(pid peer.ID) int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if state, ok := t.peers[pid]; ok {
+		return state.retries
+	}
+	return 0
+}
+
+// shouldRecordBackoffFailure reports whether Stream.close should count reason against the
+// peer's reconnect backoff. A dial that allowDial/CanDial already refused (the stream never
+// actually connected) must not re-arm the very backoff it was skipped for, or a peer parked at
+// MaxDelay would never be retried: every skipped dial would bump retries and push blockedUntil
+// out again. A deliberate, benign disconnect (DiscRequested, DiscTooManyPeers) is likewise not
+// evidence the peer is unreachable or misbehaving, and shouldn't cost it backoff either.
+func shouldRecordBackoffFailure(reason error, disc DiscReason) bool {
+	if reason == ErrStreamIsNotConnected {
+		return false
+	}
+	switch disc {
+	case DiscRequested, DiscTooManyPeers:
+		return false
+	}
+	return true
+}
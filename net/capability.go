@@ -0,0 +1,104 @@
+// Copyright (C) 2018 go-nebulas authors
+//
+// This file is part of the go-nebulas library.
+//
+// the go-nebulas library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// the go-nebulas library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with the go-nebulas library.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package net
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Capability flags advertised in HELLO/OK's Capabilities field, so the network can roll out new
+// message formats and transports without forcing every peer to upgrade in lockstep.
+const (
+	CapabilitySnappy      = "snappy"
+	CapabilityMux         = "mux/1"
+	CapabilityRelay       = "relay/1"
+	CapabilityChunkedSync = "chunked-sync"
+)
+
+// semver is a parsed Major.Minor.Patch client version.
+type semver struct {
+	major, minor, patch int
+}
+
+func parseSemver(v string) (semver, error) {
+	parts := strings.SplitN(v, ".", 3)
+	if len(parts) != 3 {
+		return semver{}, fmt.Errorf("invalid semver: %s", v)
+	}
+
+	nums := make([]int, 3)
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return semver{}, fmt.Errorf("invalid semver: %s", v)
+		}
+		nums[i] = n
+	}
+
+	return semver{major: nums[0], minor: nums[1], patch: nums[2]}, nil
+}
+
+// CheckClientVersionCompatibility reports whether a peer on version v2 is compatible with this
+// node's own version v1: same major version, and v2's minor version is at least
+// minCompatibleMinor. This replaces a hard v1 == v2 equality check, so the network no longer
+// needs a hard fork for every patch release.
+func CheckClientVersionCompatibility(v1, v2 string, minCompatibleMinor int) bool {
+	local, err := parseSemver(v1)
+	if err != nil {
+		return false
+	}
+	remote, err := parseSemver(v2)
+	if err != nil {
+		return false
+	}
+	return local.major == remote.major && remote.minor >= minCompatibleMinor
+}
+
+// capabilitySet is the set of capability strings a peer advertised in its HELLO/OK message.
+type capabilitySet map[string]struct{}
+
+func newCapabilitySet(capabilities []string) capabilitySet {
+	set := make(capabilitySet, len(capabilities))
+	for _, c := range capabilities {
+		set[c] = struct{}{}
+	}
+	return set
+}
+
+// Has reports whether the capability was advertised. A nil/zero-value capabilitySet (a peer
+// that hasn't completed handshake yet) correctly reports false for every capability.
+func (c capabilitySet) Has(capability string) bool {
+	_, ok := c[capability]
+	return ok
+}
+
+// localCapabilities lists the capabilities this node advertises in its own HELLO/OK, derived
+// from what is actually enabled in Config.
+func localCapabilities(node *Node) []string {
+	caps := []string{CapabilitySnappy}
+	if node.config.StreamMux {
+		caps = append(caps, CapabilityMux)
+	}
+	if node.config.EnableRelay {
+		caps = append(caps, CapabilityRelay)
+	}
+	return caps
+}
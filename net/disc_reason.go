@@ -0,0 +1,86 @@
+// Copyright (C) 2018 go-nebulas authors
+//
+// This file is part of the go-nebulas library.
+//
+// the go-nebulas library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// the go-nebulas library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with the go-nebulas library.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package net
+
+import "fmt"
+
+// DiscReason is a one-byte code describing why a peer stream was disconnected. It is carried as
+// the BYE message payload so the remote end -- and log aggregation on both ends -- can tell why
+// a connection was dropped, instead of an empty payload and an ad-hoc Go error string.
+type DiscReason uint8
+
+// Disconnect reasons, modeled on go-ethereum's p2p.DiscReason.
+const (
+	DiscRequested DiscReason = iota
+	DiscNetworkError
+	DiscProtocolError
+	DiscUselessPeer
+	DiscTooManyPeers
+	DiscAlreadyConnected
+	DiscIncompatibleVersion
+	DiscInvalidChainID
+	DiscHandshakeTimeout
+	DiscSubprotocolError
+)
+
+var discReasonStrings = [...]string{
+	DiscRequested:           "disconnect requested",
+	DiscNetworkError:        "network error",
+	DiscProtocolError:       "breach of protocol",
+	DiscUselessPeer:         "useless peer",
+	DiscTooManyPeers:        "too many peers",
+	DiscAlreadyConnected:    "already connected",
+	DiscIncompatibleVersion: "incompatible client version",
+	DiscInvalidChainID:      "invalid chain id",
+	DiscHandshakeTimeout:    "handshake timeout",
+	DiscSubprotocolError:    "subprotocol error",
+}
+
+// String implements fmt.Stringer.
+func (r DiscReason) String() string {
+	if int(r) < len(discReasonStrings) {
+		return discReasonStrings[r]
+	}
+	return "unknown disconnect reason"
+}
+
+// discCloseError tags an error passed to Stream.close with the DiscReason it corresponds to, so
+// close's structured logging can report a reason/reason_code instead of a bare Go error string.
+// Errors that aren't tagged (plain I/O failures) are logged as DiscNetworkError.
+type discCloseError struct {
+	reason DiscReason
+	err    error
+}
+
+func newDiscCloseError(reason DiscReason, err error) *discCloseError {
+	return &discCloseError{reason: reason, err: err}
+}
+
+func (e *discCloseError) Error() string {
+	return fmt.Sprintf("%s: %s", e.reason, e.err)
+}
+
+// discReasonOf returns the DiscReason tagged on err via newDiscCloseError, or DiscNetworkError
+// for an untagged error (the common case: a raw read/write/dial failure).
+func discReasonOf(err error) DiscReason {
+	if dce, ok := err.(*discCloseError); ok {
+		return dce.reason
+	}
+	return DiscNetworkError
+}
@@ -0,0 +1,301 @@
+// Copyright (C) 2018 go-nebulas authors
+//
+// This file is part of the go-nebulas library.
+//
+// the go-nebulas library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// the go-nebulas library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with the go-nebulas library.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package net
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	libnet "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/nebulasio/go-nebulas/util/logging"
+	"github.com/sirupsen/logrus"
+)
+
+// RelayProtocolID is this node's own lightweight relay protocol, used to proxy a connection to a
+// peer a direct dial can't reach (e.g. behind a symmetric NAT). It is deliberately not the
+// spec's "/libp2p/circuit/relay/0.1.0" id: that protocol exchanges protobuf CircuitRelay
+// messages which this package does not implement, and claiming the real id without speaking the
+// real wire format would make us interop-incompatible with anything actually implementing it.
+const RelayProtocolID = "/neb/1.0.0/circuit-relay"
+
+// RelayedProtocolID is what a hop uses to dial the real target on a relayed peer's behalf. It
+// carries one extra preamble -- the original src's peer id, written by writeRelayTarget before
+// the NebMessage framing starts -- since the physical connection's remote peer is the hop, not
+// src, and onHello's NodeId check would otherwise reject the proxied handshake.
+const RelayedProtocolID = "/neb/1.0.0/relayed"
+
+// relay defaults, used when the corresponding Config knob is left at zero value.
+const (
+	defaultMaxRelayConns        = 128
+	defaultRelayRateLimitPerMin = 10
+
+	// relayAddrTTL is how long a circuit multiaddr learned via a successful relayed connect stays
+	// in the peerstore, mirroring a normal direct-dial addr's lifetime closely enough to be
+	// gossiped through RouteTable/AddPeers in the meantime.
+	relayAddrTTL = 10 * time.Minute
+)
+
+// relayLimiters tracks the relayLimiter for every hop-enabled node. It is keyed by *Node rather
+// than stored on Node itself so that relay hop state stays isolated in this file.
+var relayLimiters sync.Map // map[*Node]*relayLimiter
+
+// relayLimiter enforces a max concurrent relay count and a per-src rate limit on a hop node, so
+// that a single misbehaving peer cannot exhaust the hop's relay capacity.
+type relayLimiter struct {
+	mutex       sync.Mutex
+	maxConns    int
+	ratePerMin  int
+	active      int
+	srcRequests map[peer.ID][]int64
+}
+
+func newRelayLimiter(maxConns, ratePerMin int) *relayLimiter {
+	if maxConns <= 0 {
+		maxConns = defaultMaxRelayConns
+	}
+	if ratePerMin <= 0 {
+		ratePerMin = defaultRelayRateLimitPerMin
+	}
+	return &relayLimiter{
+		maxConns:    maxConns,
+		ratePerMin:  ratePerMin,
+		srcRequests: make(map[peer.ID][]int64),
+	}
+}
+
+// Allow reports whether src may open a new relayed connection, bumping the active relay count
+// as a side effect. Call release() once the relayed connection ends.
+func (l *relayLimiter) Allow(src peer.ID) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.active >= l.maxConns {
+		return false
+	}
+
+	windowStart := time.Now().Add(-time.Minute).Unix()
+	recent := l.srcRequests[src][:0]
+	for _, t := range l.srcRequests[src] {
+		if t > windowStart {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= l.ratePerMin {
+		l.srcRequests[src] = recent
+		return false
+	}
+
+	l.srcRequests[src] = append(recent, time.Now().Unix())
+	l.active++
+	return true
+}
+
+func (l *relayLimiter) release() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.active > 0 {
+		l.active--
+	}
+}
+
+// RegisterRelayHandler registers the circuit-relay protocol handler on node.host so the node can
+// serve as a relay hop for peers behind symmetric NATs. It is a no-op unless Config.EnableRelay
+// and Config.RelayHop are both set.
+//
+// Node construction/start-up lives outside this package's trimmed slice of the tree (there is no
+// node.go here), so the one call this function still needs -- RegisterRelayHandler(node) once
+// node.host is up -- has to be added at that call site, not here.
+func RegisterRelayHandler(node *Node) {
+	if !node.config.EnableRelay || !node.config.RelayHop {
+		return
+	}
+
+	limiter := newRelayLimiter(node.config.MaxRelayConns, node.config.RelayRateLimitPerMin)
+	relayLimiters.Store(node, limiter)
+
+	node.host.SetStreamHandler(RelayProtocolID, func(stream libnet.Stream) {
+		src := stream.Conn().RemotePeer()
+		if !limiter.Allow(src) {
+			logging.VLog().WithFields(logrus.Fields{
+				"src": src.Pretty(),
+			}).Debug("Rejected relay request, hop limit or rate limit exceeded.")
+			stream.Reset()
+			return
+		}
+		defer limiter.release()
+
+		target, err := readRelayTarget(stream)
+		if err != nil {
+			logging.VLog().WithFields(logrus.Fields{
+				"src": src.Pretty(),
+				"err": err,
+			}).Debug("Failed to read relay target.")
+			stream.Reset()
+			return
+		}
+
+		dst, err := node.host.NewStream(node.context, target, RelayedProtocolID)
+		if err != nil {
+			logging.VLog().WithFields(logrus.Fields{
+				"src":    src.Pretty(),
+				"target": target.Pretty(),
+				"err":    err,
+			}).Debug("Failed to reach relay target, refusing.")
+			writeRelayAck(stream, false)
+			stream.Close()
+			return
+		}
+
+		if err := writeRelayTarget(dst, src); err != nil {
+			stream.Reset()
+			dst.Reset()
+			return
+		}
+
+		if err := writeRelayAck(stream, true); err != nil {
+			stream.Reset()
+			dst.Reset()
+			return
+		}
+
+		logging.VLog().WithFields(logrus.Fields{
+			"src":    src.Pretty(),
+			"target": target.Pretty(),
+		}).Debug("Proxying relayed connection.")
+		proxyStreams(stream, dst)
+	})
+
+	logging.VLog().Info("Registered node as circuit-relay hop.")
+}
+
+// dialRelayed opens a stream to hop speaking RelayProtocolID, asks it to proxy to target, and
+// returns the resulting stream once hop acknowledges the proxied connection is up. The returned
+// stream carries raw NebProtocolID framing end-to-end, exactly as a direct stream to target
+// would, so callers don't need to know the connection is relayed.
+func dialRelayed(node *Node, hop, target peer.ID) (libnet.Stream, error) {
+	stream, err := node.host.NewStream(node.context, hop, RelayProtocolID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeRelayTarget(stream, target); err != nil {
+		stream.Reset()
+		return nil, err
+	}
+
+	ok, err := readRelayAck(stream)
+	if err != nil {
+		stream.Reset()
+		return nil, err
+	}
+	if !ok {
+		stream.Reset()
+		return nil, fmt.Errorf("relay hop %s refused to proxy to %s", hop.Pretty(), target.Pretty())
+	}
+
+	return stream, nil
+}
+
+// circuitAddr builds the hop-qualified /p2p-circuit multiaddr for target, in the real libp2p
+// circuit-relay address form, so a relayed connection has a genuine address to advertise and
+// gossip through RouteTable/AddPeers. Nothing in this host registers the libp2p relay transport,
+// so the address itself can't be redialed by a third node the way a real circuit-relay setup
+// would allow -- only this package's own dialRelayed, going through RelayProtocolID, can use it.
+func circuitAddr(hop, target peer.ID) (ma.Multiaddr, error) {
+	return ma.NewMultiaddr(fmt.Sprintf("/p2p/%s/p2p-circuit/ipfs/%s", hop.Pretty(), target.Pretty()))
+}
+
+// writeRelayTarget writes target's base58 peer id to w, length-prefixed by a single byte, the
+// same small-framing convention NebMessage itself follows for its own header fields.
+func writeRelayTarget(w io.Writer, target peer.ID) error {
+	id := []byte(target.Pretty())
+	if len(id) > 0xff {
+		return fmt.Errorf("relay target id too long: %d bytes", len(id))
+	}
+	if _, err := w.Write([]byte{byte(len(id))}); err != nil {
+		return err
+	}
+	_, err := w.Write(id)
+	return err
+}
+
+func readRelayTarget(r io.Reader) (peer.ID, error) {
+	var idLen [1]byte
+	if _, err := io.ReadFull(r, idLen[:]); err != nil {
+		return "", err
+	}
+
+	idBuf := make([]byte, idLen[0])
+	if _, err := io.ReadFull(r, idBuf); err != nil {
+		return "", err
+	}
+
+	return peer.IDB58Decode(string(idBuf))
+}
+
+func writeRelayAck(w io.Writer, ok bool) error {
+	ack := byte(0)
+	if ok {
+		ack = 1
+	}
+	_, err := w.Write([]byte{ack})
+	return err
+}
+
+func readRelayAck(r io.Reader) (bool, error) {
+	var ack [1]byte
+	if _, err := io.ReadFull(r, ack[:]); err != nil {
+		return false, err
+	}
+	return ack[0] == 1, nil
+}
+
+// proxyStreams splices a and b together bidirectionally until either side's read returns, then
+// closes both ends, so a relayed connection behaves like a direct one from each endpoint's view.
+func proxyStreams(a, b libnet.Stream) {
+	done := make(chan struct{}, 2)
+	copyAndSignal := func(dst io.Writer, src io.Reader) {
+		io.Copy(dst, src)
+		done <- struct{}{}
+	}
+
+	go copyAndSignal(a, b)
+	go copyAndSignal(b, a)
+	<-done
+
+	a.Close()
+	b.Close()
+}
+
+// isNoRouteErr reports whether err looks like a dial failure that should trigger a
+// circuit-relay fallback rather than being treated as a final, fatal dial error.
+func isNoRouteErr(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "no route to host") ||
+		strings.Contains(msg, "connection refused") ||
+		strings.Contains(msg, "dial backoff")
+}
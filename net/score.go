@@ -0,0 +1,249 @@
+// Copyright (C) 2018 go-nebulas authors
+//
+// This file is part of the go-nebulas library.
+//
+// the go-nebulas library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// the go-nebulas library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with the go-nebulas library.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package net
+
+import (
+	"sync"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	"github.com/nebulasio/go-nebulas/util/logging"
+	"github.com/sirupsen/logrus"
+)
+
+// Score deltas applied for well- and ill-behaved peers, modeled on the shrex peer-manager pool:
+// small additive bumps for good behavior, larger immediate penalties for bad behavior, so a
+// single abusive message outweighs a long run of good ones.
+const (
+	scoreDeltaHandshake        = 1
+	scoreDeltaValidatedGossip  = 1
+	scoreDeltaTimelySyncRoute  = 1
+	scoreDeltaUncompressFail   = -5
+	scoreDeltaInvalidChainID   = -10
+	scoreDeltaInvalidProto     = -5
+	scoreDeltaOversizedMessage = -5
+	scoreDeltaQueueCapHit      = -2
+	scoreDeltaHandshakeTimeout = -5
+)
+
+// score defaults, used when the corresponding ScoreConfig field is left at zero value.
+const (
+	defaultMinScoreToAccept = -20
+	defaultMinScoreToDial   = -20
+	defaultBanScore         = -50
+
+	// banDecay is how long a peer stays on the banlist after hitting BanScore; its score can
+	// then start recovering instead of being permanently blackholed.
+	banDecay = 24 * time.Hour
+
+	// scoreDecayPerHour recovers a peer's score toward zero at this rate per hour it goes
+	// without a fresh adjust(). Without this, a score that hit BanScore would stay there
+	// forever -- CanAccept/CanDial would keep rejecting the peer long after its ban window
+	// (banDecay) lapsed, since nothing ever moved the score back above the thresholds.
+	scoreDecayPerHour = 2
+
+	// scoreDecayInterval is the minimum elapsed time before decay is applied at all, so a peer
+	// adjusted every few seconds doesn't pay a rounding-induced decay on every single call.
+	scoreDecayInterval = time.Hour
+)
+
+// ScoreConfig exposes the admission-control thresholds consulted when accepting or dialing a
+// stream and when deciding whether a peer has earned a ban.
+type ScoreConfig struct {
+	MinScoreToAccept int
+	MinScoreToDial   int
+	BanScore         int
+}
+
+// DefaultScoreConfig returns the thresholds used when Config.Score is left unset.
+func DefaultScoreConfig() *ScoreConfig {
+	return &ScoreConfig{
+		MinScoreToAccept: defaultMinScoreToAccept,
+		MinScoreToDial:   defaultMinScoreToDial,
+		BanScore:         defaultBanScore,
+	}
+}
+
+// peerScore is one peer's reputation state.
+type peerScore struct {
+	value      int
+	lastUpdate time.Time
+	bannedAt   time.Time
+}
+
+// scoreTracker is a per-Node registry of peer reputation, mirroring the relayLimiters/
+// backoffTrackers registries so this subsystem doesn't need a new field threaded through Node.
+// NewStream consults it for inbound admission, Stream.Connect for outbound dial, and it is
+// updated throughout the stream lifecycle (handshake, gossip, malformed/oversized messages,
+// queue overflows). ScoreStore, when set, persists scores across restarts (e.g. to leveldb).
+type scoreTracker struct {
+	mutex sync.Mutex
+	cfg   *ScoreConfig
+	store ScoreStore
+	peers map[peer.ID]*peerScore
+}
+
+// ScoreStore persists peer scores across restarts. A leveldb-backed implementation can be
+// plugged in via Config.ScoreStore; nil (the default) keeps scores in memory only.
+type ScoreStore interface {
+	Load(pid peer.ID) (int, bool)
+	Save(pid peer.ID, score int)
+}
+
+func newScoreTracker(cfg *ScoreConfig, store ScoreStore) *scoreTracker {
+	if cfg == nil {
+		cfg = DefaultScoreConfig()
+	}
+	return &scoreTracker{cfg: cfg, store: store, peers: make(map[peer.ID]*peerScore)}
+}
+
+var scoreTrackers sync.Map // map[*Node]*scoreTracker
+
+func scoreTrackerFor(node *Node) *scoreTracker {
+	v, _ := scoreTrackers.LoadOrStore(node, newScoreTracker(node.config.Score, node.config.ScoreStore))
+	return v.(*scoreTracker)
+}
+
+// get returns pid's score state, lazily loading it from the persistent store on first access and
+// applying any decay owed since its last adjustment. Callers must hold t.mutex.
+func (t *scoreTracker) get(pid peer.ID) *peerScore {
+	s, ok := t.peers[pid]
+	if ok {
+		t.decay(s)
+		return s
+	}
+
+	s = &peerScore{lastUpdate: time.Now()}
+	if t.store != nil {
+		if loaded, ok := t.store.Load(pid); ok {
+			s.value = loaded
+		}
+	}
+	t.peers[pid] = s
+	return s
+}
+
+// decay recovers s's score toward zero based on how many full scoreDecayInterval periods have
+// elapsed since its last adjustment, so a peer that stops misbehaving (or stops being useful)
+// eventually crosses back over MinScoreToAccept/MinScoreToDial instead of staying pinned at
+// whatever extreme it last hit. Callers must hold t.mutex.
+func (t *scoreTracker) decay(s *peerScore) {
+	periods := int(time.Since(s.lastUpdate) / scoreDecayInterval)
+	if periods <= 0 {
+		return
+	}
+
+	step := periods * scoreDecayPerHour
+	switch {
+	case s.value > 0:
+		s.value -= step
+		if s.value < 0 {
+			s.value = 0
+		}
+	case s.value < 0:
+		s.value += step
+		if s.value > 0 {
+			s.value = 0
+		}
+	}
+	s.lastUpdate = s.lastUpdate.Add(time.Duration(periods) * scoreDecayInterval)
+}
+
+// banActive reports whether s is still inside its ban window, lazily clearing bannedAt once
+// banDecay has elapsed since it was set. Without this, a repeat offender whose ban window has
+// already lapsed could never be banned again: adjust's bannedAt.IsZero() guard would still see
+// the stale non-zero timestamp from the first ban and refuse to re-arm it. Callers must hold
+// t.mutex.
+func (t *scoreTracker) banActive(s *peerScore) bool {
+	if s.bannedAt.IsZero() {
+		return false
+	}
+	if time.Since(s.bannedAt) > banDecay {
+		s.bannedAt = time.Time{}
+		return false
+	}
+	return true
+}
+
+// adjust applies delta to pid's score, logging the reason and banning the peer once its score
+// drops to BanScore.
+func (t *scoreTracker) adjust(pid peer.ID, delta int, reason string) {
+	t.mutex.Lock()
+	s := t.get(pid)
+	s.value += delta
+	s.lastUpdate = time.Now()
+	newlyBanned := delta < 0 && s.value <= t.cfg.BanScore && !t.banActive(s)
+	if newlyBanned {
+		s.bannedAt = time.Now()
+	}
+	value := s.value
+	if t.store != nil {
+		t.store.Save(pid, value)
+	}
+	t.mutex.Unlock()
+
+	logging.VLog().WithFields(logrus.Fields{
+		"pid":    pid.Pretty(),
+		"delta":  delta,
+		"score":  value,
+		"reason": reason,
+	}).Debug("Adjusted peer score.")
+
+	if newlyBanned {
+		logging.VLog().WithFields(logrus.Fields{
+			"pid":   pid.Pretty(),
+			"score": value,
+		}).Warn("Peer score hit the ban threshold.")
+	}
+}
+
+// Score returns pid's current score. This package reads it only for log fields; it is not
+// registered with the metrics registry.
+func (t *scoreTracker) Score(pid peer.ID) int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.get(pid).value
+}
+
+// IsBanned reports whether pid is still inside its time-decayed ban window. A ConnectionGater
+// on node.host should consult this before accepting a transport-level connection from pid.
+func (t *scoreTracker) IsBanned(pid peer.ID) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	s, ok := t.peers[pid]
+	if !ok {
+		return false
+	}
+	return t.banActive(s)
+}
+
+// CanAccept reports whether an inbound stream from pid should be accepted.
+func (t *scoreTracker) CanAccept(pid peer.ID) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.get(pid).value >= t.cfg.MinScoreToAccept
+}
+
+// CanDial reports whether pid may be dialed outbound.
+func (t *scoreTracker) CanDial(pid peer.ID) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.get(pid).value >= t.cfg.MinScoreToDial
+}
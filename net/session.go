@@ -0,0 +1,153 @@
+// Copyright (C) 2018 go-nebulas authors
+//
+// This file is part of the go-nebulas library.
+//
+// the go-nebulas library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// the go-nebulas library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with the go-nebulas library.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package net
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// NebMuxProtocolID is offered alongside NebProtocolID when Config.StreamMux is enabled.
+// multistream-select picks it over the legacy protocol whenever the remote also supports it,
+// so peers that don't understand yamux framing keep working unmodified.
+const NebMuxProtocolID = "/neb/1.0.0/mux"
+
+// muxBulkThreshold is the payload size, in bytes, at or above which a message is routed onto the
+// dedicated bulk sub-stream (e.g. block/chunk sync) instead of its priority sub-stream.
+const muxBulkThreshold = 32 * 1024
+
+// Logical sub-stream classes multiplexed over a single physical libp2p stream via yamux: one
+// per message priority, plus a dedicated one for large payloads like block/chunk sync.
+const (
+	subStreamHigh = iota
+	subStreamNormal
+	subStreamLow
+	subStreamBulk
+)
+
+var subStreamClasses = []int{subStreamHigh, subStreamNormal, subStreamLow, subStreamBulk}
+
+func subStreamName(class int) string {
+	switch class {
+	case subStreamHigh:
+		return "high"
+	case subStreamNormal:
+		return "normal"
+	case subStreamLow:
+		return "low"
+	case subStreamBulk:
+		return "bulk"
+	default:
+		return "unknown"
+	}
+}
+
+// muxSession wraps a single physical libp2p stream in a yamux session and hands out one logical
+// sub-stream per priority class plus a dedicated sub-stream for bulk payloads, so a slow bulk
+// transfer can no longer head-of-line block handshake or heartbeat traffic.
+type muxSession struct {
+	session  *yamux.Session
+	mutex    sync.Mutex
+	subs     map[int]*yamux.Stream
+	writeMus map[int]*sync.Mutex
+}
+
+// newMuxSession opens a yamux session over conn and eagerly opens/accepts one logical
+// sub-stream per class. client must match which side physically dialed the underlying stream,
+// since that decides which end opens vs. accepts each logical sub-stream first.
+func newMuxSession(conn io.ReadWriteCloser, client bool) (*muxSession, error) {
+	cfg := yamux.DefaultConfig()
+
+	var session *yamux.Session
+	var err error
+	if client {
+		session, err = yamux.Client(conn, cfg)
+	} else {
+		session, err = yamux.Server(conn, cfg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ms := &muxSession{
+		session:  session,
+		subs:     make(map[int]*yamux.Stream, len(subStreamClasses)),
+		writeMus: make(map[int]*sync.Mutex, len(subStreamClasses)),
+	}
+
+	for _, class := range subStreamClasses {
+		var sub *yamux.Stream
+		if client {
+			sub, err = session.OpenStream()
+		} else {
+			sub, err = session.AcceptStream()
+		}
+		if err != nil {
+			session.Close()
+			return nil, err
+		}
+		ms.subs[class] = sub
+		ms.writeMus[class] = new(sync.Mutex)
+	}
+
+	return ms, nil
+}
+
+// subStream returns the logical sub-stream dedicated to class.
+func (ms *muxSession) subStream(class int) *yamux.Stream {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	return ms.subs[class]
+}
+
+// writeTo writes data to class's sub-stream while holding that class's dedicated write mutex, so
+// a synchronous caller (Hello/Ok/Bye, route-table replies) can never interleave its bytes with
+// muxWriteLoop, which drains the same class's queued messages from a long-running goroutine.
+func (ms *muxSession) writeTo(class int, data []byte, deadline time.Time) (int, error) {
+	sub := ms.subStream(class)
+	if sub == nil {
+		return 0, fmt.Errorf("missing yamux sub-stream: %s", subStreamName(class))
+	}
+
+	ms.mutex.Lock()
+	mu := ms.writeMus[class]
+	ms.mutex.Unlock()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if err := sub.SetWriteDeadline(deadline); err != nil {
+		return 0, err
+	}
+	return sub.Write(data)
+}
+
+// Close tears down every logical sub-stream and the underlying yamux session.
+func (ms *muxSession) Close() error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	for _, sub := range ms.subs {
+		sub.Close()
+	}
+	return ms.session.Close()
+}
@@ -22,6 +22,7 @@ import (
 	"errors"
 	"fmt"
 	"hash/crc32"
+	"io"
 	"sync"
 	"time"
 
@@ -30,6 +31,7 @@ import (
 	"github.com/gogo/protobuf/proto"
 	libnet "github.com/libp2p/go-libp2p-net"
 	peer "github.com/libp2p/go-libp2p-peer"
+	protocol "github.com/libp2p/go-libp2p-protocol"
 	ma "github.com/multiformats/go-multiaddr"
 	netpb "github.com/nebulasio/go-nebulas/net/pb"
 	"github.com/nebulasio/go-nebulas/util/logging"
@@ -48,6 +50,14 @@ const (
 	RECVEDMSG     = "recvedmsg"
 )
 
+// maxNebMessageDataLength caps a single message's data length; anything larger is treated as
+// abusive rather than parsed, so a malicious peer can't force unbounded buffer growth.
+const maxNebMessageDataLength = 32 * 1024 * 1024
+
+// handshakeTimeout bounds how long any write loop -- legacy or per-class mux -- waits for the
+// handshake to finish before giving up on the stream.
+const handshakeTimeout = 30 * time.Second
+
 // Stream Status
 const (
 	streamStatusInit = iota
@@ -74,6 +84,7 @@ type Stream struct {
 	highPriorityMessageChan   chan *NebMessage
 	normalPriorityMessageChan chan *NebMessage
 	lowPriorityMessageChan    chan *NebMessage
+	bulkMessageChan           chan *NebMessage
 	quitWriteCh               chan bool
 	status                    int
 	connectedAt               int64
@@ -81,16 +92,98 @@ type Stream struct {
 	latestWriteAt             int64
 	msgCount                  map[string]int
 	compressFlag              *sync.Map
+	mux                       *muxSession
+	muxEnabled                bool
+	writeMutex                sync.Mutex
+	capabilities              capabilitySet
+	pendingDiscReason         DiscReason
+	outbound                  bool
 }
 
-// NewStream return a new Stream
+// NewStream return a new Stream, or nil if pid's score is too low to admit an inbound
+// connection (see ScoreConfig.MinScoreToAccept) or it is currently banned.
 func NewStream(stream libnet.Stream, node *Node) *Stream {
-	return newStreamInstance(stream.Conn().RemotePeer(), stream.Conn().RemoteMultiaddr(), stream, node)
+	pid := stream.Conn().RemotePeer()
+	return newInboundStream(pid, stream.Conn().RemoteMultiaddr(), stream, node)
+}
+
+// NewRelayedStream is like NewStream, but for a stream arriving over RelayedProtocolID: the
+// physical connection's remote peer is the relay hop dialing on src's behalf, not src itself, so
+// src (read off the relay preamble by RegisterStreamHandler) is used as the Stream's pid instead
+// of stream.Conn().RemotePeer(). Using the hop's id here would make onHello reject the proxied
+// handshake, since the Hello it carries (forwarded byte-for-byte from src) names src's own
+// NodeId.
+func NewRelayedStream(stream libnet.Stream, src peer.ID, node *Node) *Stream {
+	return newInboundStream(src, nil, stream, node)
+}
+
+// newInboundStream applies score-based admission control to pid and, if accepted, wraps stream
+// in a Stream instance. Returns nil (after resetting stream) if pid is banned or its score is
+// too low to admit.
+func newInboundStream(pid peer.ID, addr ma.Multiaddr, stream libnet.Stream, node *Node) *Stream {
+	scores := scoreTrackerFor(node)
+	if scores.IsBanned(pid) || !scores.CanAccept(pid) {
+		logging.VLog().WithFields(logrus.Fields{
+			"pid":   pid.Pretty(),
+			"score": scores.Score(pid),
+		}).Debug("Rejecting inbound stream, peer score too low.")
+		stream.Reset()
+		return nil
+	}
+
+	s := newStreamInstance(pid, addr, stream, node)
+	s.initMux(stream, false)
+	return s
+}
+
+// RegisterStreamHandler registers this package's own stream protocols on node.host: the legacy
+// NebProtocolID always, NebMuxProtocolID as well when Config.StreamMux is enabled, and
+// RelayedProtocolID so this node can serve as the target end of a relayed connection set up by
+// relay.go's RegisterRelayHandler. Every inbound stream goes through NewStream/NewRelayedStream,
+// which can return nil for a peer whose score is too low to admit (see
+// ScoreConfig.MinScoreToAccept) -- this handler is the one place that must guard against that nil
+// before calling StartLoop.
+//
+// Node construction/start-up lives outside this package's trimmed slice of the tree (there is no
+// node.go here), so the call to wire this up -- RegisterStreamHandler(node) once node.host is up,
+// alongside RegisterRelayHandler -- has to be added at that call site, not here.
+func RegisterStreamHandler(node *Node) {
+	handler := func(stream libnet.Stream) {
+		s := NewStream(stream, node)
+		if s == nil {
+			return
+		}
+		s.StartLoop()
+	}
+
+	node.host.SetStreamHandler(NebProtocolID, handler)
+	if node.config.StreamMux {
+		node.host.SetStreamHandler(NebMuxProtocolID, handler)
+	}
+
+	node.host.SetStreamHandler(RelayedProtocolID, func(stream libnet.Stream) {
+		src, err := readRelayTarget(stream)
+		if err != nil {
+			logging.VLog().WithFields(logrus.Fields{
+				"err": err,
+			}).Debug("Failed to read relayed stream's source peer id.")
+			stream.Reset()
+			return
+		}
+
+		s := NewRelayedStream(stream, src, node)
+		if s == nil {
+			return
+		}
+		s.StartLoop()
+	})
 }
 
 // NewStreamFromPID return a new Stream based on the pid
 func NewStreamFromPID(pid peer.ID, node *Node) *Stream {
-	return newStreamInstance(pid, nil, nil, node)
+	s := newStreamInstance(pid, nil, nil, node)
+	s.outbound = true
+	return s
 }
 
 func newStreamInstance(pid peer.ID, addr ma.Multiaddr, stream libnet.Stream, node *Node) *Stream {
@@ -104,8 +197,10 @@ func newStreamInstance(pid peer.ID, addr ma.Multiaddr, stream libnet.Stream, nod
 		highPriorityMessageChan:   make(chan *NebMessage, 2*1024),
 		normalPriorityMessageChan: make(chan *NebMessage, 2*1024),
 		lowPriorityMessageChan:    make(chan *NebMessage, 2*1024),
+		bulkMessageChan:           make(chan *NebMessage, 64),
 		quitWriteCh:               make(chan bool, 1),
 		status:                    streamStatusInit,
+		pendingDiscReason:         DiscProtocolError,
 		connectedAt:               time.Now().Unix(),
 		latestReadAt:              0,
 		latestWriteAt:             0,
@@ -116,6 +211,22 @@ func newStreamInstance(pid peer.ID, addr ma.Multiaddr, stream libnet.Stream, nod
 
 // Connect to the stream
 func (s *Stream) Connect() error {
+	if !backoffTrackerFor(s.node).allowDial(s.pid) {
+		logging.VLog().WithFields(logrus.Fields{
+			"stream": s.String(),
+		}).Debug("Skipping dial, peer is under reconnect backoff.")
+		return ErrStreamIsNotConnected
+	}
+
+	scores := scoreTrackerFor(s.node)
+	if scores.IsBanned(s.pid) || !scores.CanDial(s.pid) {
+		logging.VLog().WithFields(logrus.Fields{
+			"stream": s.String(),
+			"score":  scores.Score(s.pid),
+		}).Debug("Skipping dial, peer score too low.")
+		return ErrStreamIsNotConnected
+	}
+
 	logging.VLog().WithFields(logrus.Fields{
 		"stream": s.String(),
 	}).Debug("Connecting to peer.")
@@ -124,9 +235,12 @@ func (s *Stream) Connect() error {
 	stream, err := s.node.host.NewStream(
 		s.node.context,
 		s.pid,
-		NebProtocolID,
+		s.dialProtocolIDs()...,
 	)
 	if err != nil {
+		if s.node.config.EnableRelay && isNoRouteErr(err) {
+			return s.connectViaRelay()
+		}
 		logging.VLog().WithFields(logrus.Fields{
 			"stream": s.String(),
 			"err":    err,
@@ -135,10 +249,87 @@ func (s *Stream) Connect() error {
 	}
 	s.stream = stream
 	s.addr = stream.Conn().RemoteMultiaddr()
+	s.initMux(stream, true)
 
 	return nil
 }
 
+// dialProtocolIDs returns the protocol IDs to offer when dialing s.pid, preferring the
+// yamux-multiplexed protocol over the legacy single-stream one when Config.StreamMux is set.
+// multistream-select picks the first one the remote also supports, so old peers still get the
+// legacy framing.
+func (s *Stream) dialProtocolIDs() []protocol.ID {
+	if s.node.config.StreamMux {
+		return []protocol.ID{NebMuxProtocolID, NebProtocolID}
+	}
+	return []protocol.ID{NebProtocolID}
+}
+
+// connectViaRelay falls back to proxying through one of Config.RelayHops after a direct dial to
+// s.pid failed with a "no route to host" style error, so peers behind symmetric NATs stay
+// reachable. It tries each configured hop in turn and keeps the first one that accepts.
+func (s *Stream) connectViaRelay() error {
+	hops := s.node.config.RelayHops
+	if len(hops) == 0 {
+		return ErrStreamIsNotConnected
+	}
+
+	var lastErr error
+	for _, hop := range hops {
+		stream, err := dialRelayed(s.node, hop, s.pid)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		addr, err := circuitAddr(hop, s.pid)
+		if err != nil {
+			lastErr = err
+			stream.Reset()
+			continue
+		}
+		s.node.host.Peerstore().AddAddr(s.pid, addr, relayAddrTTL)
+
+		logging.VLog().WithFields(logrus.Fields{
+			"stream": s.String(),
+			"hop":    hop.Pretty(),
+			"addr":   addr.String(),
+		}).Debug("Direct dial failed, connected via circuit-relay hop.")
+
+		s.stream = stream
+		s.addr = addr
+		s.initMux(stream, true)
+		return nil
+	}
+
+	logging.VLog().WithFields(logrus.Fields{
+		"stream": s.String(),
+		"err":    lastErr,
+	}).Debug("Failed to connect to host via any configured relay hop.")
+	return lastErr
+}
+
+// initMux upgrades stream to a yamux session when both sides negotiated the mux protocol ID via
+// multistream-select. client indicates which side opened the physical stream, since that
+// decides which end opens vs. accepts each logical sub-stream first.
+func (s *Stream) initMux(stream libnet.Stream, client bool) {
+	if !s.node.config.StreamMux || stream == nil || stream.Protocol() != NebMuxProtocolID {
+		return
+	}
+
+	mux, err := newMuxSession(stream, client)
+	if err != nil {
+		logging.VLog().WithFields(logrus.Fields{
+			"stream": s.String(),
+			"err":    err,
+		}).Debug("Failed to establish yamux session, falling back to single-stream framing.")
+		return
+	}
+
+	s.mux = mux
+	s.muxEnabled = true
+}
+
 // IsConnected return if the stream is connected
 func (s *Stream) IsConnected() bool {
 	return s.stream != nil
@@ -149,6 +340,14 @@ func (s *Stream) IsHandshakeSucceed() bool {
 	return s.status == streamStatusHandshakeSucceed
 }
 
+// RewardUsefulGossip bumps the peer's score after a message it relayed (a block, transaction, or
+// route table entry) is later validated by the consuming subsystem. Callers outside this package
+// hold the relevant Stream via the net dispatcher, so the reward can only be applied once
+// validation -- which may take multiple blocks to settle -- actually completes.
+func (s *Stream) RewardUsefulGossip() {
+	scoreTrackerFor(s.node).adjust(s.pid, scoreDeltaValidatedGossip, "gossiped message validated")
+}
+
 func (s *Stream) String() string {
 	addrStr := ""
 	if s.addr != nil {
@@ -173,9 +372,22 @@ func (s *Stream) SendProtoMessage(messageName string, pb proto.Message, priority
 	return s.SendMessage(messageName, data, priority)
 }
 
+// shouldCompress reports whether outgoing messages may be snappy-compressed, i.e. whether the
+// peer has advertised the "snappy" capability in its HELLO/OK. Both NewNebMessage call sites
+// consult this before setting the compress bit in Reserved()[0], so a peer that never
+// advertised snappy is never handed data it doesn't know how to decompress.
+func (s *Stream) shouldCompress() bool {
+	return s.capabilities.Has(CapabilitySnappy)
+}
+
 // SendMessage send msg to buffer
 func (s *Stream) SendMessage(messageName string, data []byte, priority int) error {
-	message, err := NewNebMessage(s, DefaultReserved, 0, messageName, data)
+	reserved := append([]byte(nil), DefaultReserved...)
+	if !s.shouldCompress() {
+		reserved[0] &^= 0x80
+	}
+
+	message, err := NewNebMessage(s, reserved, 0, messageName, data)
 	if err != nil {
 		return err
 	}
@@ -186,6 +398,21 @@ func (s *Stream) SendMessage(messageName string, data []byte, priority int) erro
 	// send to pool.
 	message.FlagSendMessageAt()
 
+	// large payloads (e.g. block/chunk sync) go over their own yamux sub-stream so a slow bulk
+	// transfer cannot head-of-line block handshake/heartbeat traffic on the priority sub-streams.
+	if s.muxEnabled && len(data) >= muxBulkThreshold {
+		select {
+		case s.bulkMessageChan <- message:
+		default:
+			logging.VLog().WithFields(logrus.Fields{
+				"bulkMessageChan.len": len(s.bulkMessageChan),
+				"stream":              s.String(),
+			}).Debug("Received too many bulk messages.")
+			scoreTrackerFor(s.node).adjust(s.pid, scoreDeltaQueueCapHit, "bulk message queue full")
+		}
+		return nil
+	}
+
 	// use a non-blocking channel to avoid blocking when the channel is full.
 	switch priority {
 	case MessagePriorityHigh:
@@ -198,6 +425,7 @@ func (s *Stream) SendMessage(messageName string, data []byte, priority int) erro
 				"normalPriorityMessageChan.len": len(s.normalPriorityMessageChan),
 				"stream":                        s.String(),
 			}).Debug("Received too many normal priority message.")
+			scoreTrackerFor(s.node).adjust(s.pid, scoreDeltaQueueCapHit, "normal priority queue full")
 			return nil
 		}
 	default:
@@ -208,6 +436,7 @@ func (s *Stream) SendMessage(messageName string, data []byte, priority int) erro
 				"lowPriorityMessageChan.len": len(s.lowPriorityMessageChan),
 				"stream":                     s.String(),
 			}).Debug("Received too many low priority message.")
+			scoreTrackerFor(s.node).adjust(s.pid, scoreDeltaQueueCapHit, "low priority queue full")
 			return nil
 		}
 	}
@@ -231,10 +460,22 @@ func (s *Stream) Write(data []byte) error {
 
 	// at least 5kb/s to write message
 	deadline := time.Now().Add(time.Duration(len(data)/1024/5+1) * time.Second)
-	if err := s.stream.SetWriteDeadline(deadline); err != nil {
-		return err
+
+	var n int
+	var err error
+	if s.muxEnabled {
+		// synchronous writes (handshake, bye, route table replies) always go over the control
+		// sub-stream when muxing is enabled, since the physical stream itself now only carries
+		// yamux framing. mux.writeTo serializes against muxWriteLoop(subStreamHigh), which drains
+		// the same sub-stream concurrently from queued SendMessage calls.
+		n, err = s.mux.writeTo(subStreamHigh, data, deadline)
+	} else {
+		s.writeMutex.Lock()
+		if err = s.stream.SetWriteDeadline(deadline); err == nil {
+			n, err = s.stream.Write(data)
+		}
+		s.writeMutex.Unlock()
 	}
-	n, err := s.stream.Write(data)
 	if err != nil {
 		logging.VLog().WithFields(logrus.Fields{
 			"err":    err,
@@ -280,7 +521,12 @@ func (s *Stream) WriteProtoMessage(messageName string, pb proto.Message) error {
 
 // WriteMessage write raw msg in the stream
 func (s *Stream) WriteMessage(messageName string, data []byte) error {
-	message, err := NewNebMessage(s, DefaultReserved, 0, messageName, data)
+	reserved := append([]byte(nil), DefaultReserved...)
+	if !s.shouldCompress() {
+		reserved[0] &^= 0x80
+	}
+
+	message, err := NewNebMessage(s, reserved, 0, messageName, data)
 	if err != nil {
 		return err
 	}
@@ -290,12 +536,16 @@ func (s *Stream) WriteMessage(messageName string, data []byte) error {
 
 // StartLoop start stream handling loop.
 func (s *Stream) StartLoop() {
-	go s.writeLoop()
-	go s.readLoop()
+	go s.loop()
 }
 
-func (s *Stream) readLoop() {
-	// send Hello to host if stream is not connected.
+// loop connects (if this side is the dialer) and performs the handshake, then dispatches to
+// either the legacy single-stream read/write loops or the per-class yamux loops. Which one
+// applies is only known once Connect has actually run: Connect is what calls initMux and sets
+// muxEnabled, since the physical dial (and multistream-select's protocol negotiation) haven't
+// happened yet for a stream built via NewStreamFromPID. Branching on muxEnabled any earlier
+// would pick the legacy path for every outbound peer regardless of what got negotiated.
+func (s *Stream) loop() {
 	if !s.IsConnected() {
 		if err := s.Connect(); err != nil {
 			s.close(err)
@@ -307,14 +557,39 @@ func (s *Stream) readLoop() {
 		}
 	}
 
-	// loop.
+	if s.muxEnabled {
+		for _, class := range subStreamClasses {
+			class := class
+			go s.muxReadLoop(class)
+			go s.muxWriteLoop(class)
+		}
+		return
+	}
+
+	go s.writeLoop()
+	s.pumpFrames(s.stream)
+}
+
+func (s *Stream) muxReadLoop(class int) {
+	sub := s.mux.subStream(class)
+	if sub == nil {
+		s.close(fmt.Errorf("missing yamux sub-stream: %s", subStreamName(class)))
+		return
+	}
+	s.pumpFrames(sub)
+}
+
+// pumpFrames reads length-prefixed NebMessage frames from r until an error occurs, dispatching
+// each to handleMessage. It is shared by loop's legacy single-stream read path and, once muxing
+// is negotiated, by muxReadLoop for every logical sub-stream.
+func (s *Stream) pumpFrames(r io.Reader) {
 	buf := make([]byte, 1024*4)
 	messageBuffer := make([]byte, 0)
 
 	var message *NebMessage
 
 	for {
-		n, err := s.stream.Read(buf)
+		n, err := r.Read(buf)
 		if err != nil {
 			logging.VLog().WithFields(logrus.Fields{
 				"err":    err,
@@ -339,7 +614,7 @@ func (s *Stream) readLoop() {
 
 				message, err = ParseNebMessage(messageBuffer)
 				if err != nil {
-					s.Bye()
+					s.Bye(DiscProtocolError)
 					return
 				}
 
@@ -351,7 +626,18 @@ func (s *Stream) readLoop() {
 						"conf.chainID":    s.node.config.ChainID,
 						"message.chainID": message.ChainID(),
 					}).Warn("Invalid chainID, disconnect the connection.")
-					s.Bye()
+					scoreTrackerFor(s.node).adjust(s.pid, scoreDeltaInvalidChainID, "invalid chain id")
+					s.Bye(DiscInvalidChainID)
+					return
+				}
+
+				if message.DataLength() > maxNebMessageDataLength {
+					logging.VLog().WithFields(logrus.Fields{
+						"stream":     s.String(),
+						"dataLength": message.DataLength(),
+					}).Warn("Oversized message, disconnect the connection.")
+					scoreTrackerFor(s.node).adjust(s.pid, scoreDeltaOversizedMessage, "oversized message")
+					s.Bye(DiscProtocolError)
 					return
 				}
 
@@ -366,7 +652,7 @@ func (s *Stream) readLoop() {
 			}
 
 			if err := message.ParseMessageData(messageBuffer); err != nil {
-				s.Bye()
+				s.Bye(DiscProtocolError)
 				return
 			}
 
@@ -380,7 +666,7 @@ func (s *Stream) readLoop() {
 
 			// handle message.
 			if err := s.handleMessage(message); err == ErrShouldCloseConnectionAndExitLoop {
-				s.Bye()
+				s.Bye(s.pendingDiscReason)
 				return
 			}
 
@@ -390,22 +676,35 @@ func (s *Stream) readLoop() {
 	}
 }
 
-func (s *Stream) writeLoop() {
-	// waiting for handshake succeed.
-	handshakeTimeoutTicker := time.NewTicker(30 * time.Second)
+// awaitHandshake blocks until finishHandshake closes handshakeSucceedCh, s.quitWriteCh fires, or
+// handshakeTimeout elapses, whichever comes first. Every write loop -- the single legacy one or
+// one per mux sub-stream class -- calls this before it starts draining queued app messages, so a
+// peer that stalls mid-handshake is closed and penalized the same way regardless of which path
+// negotiated. Returns false if the caller should return immediately without draining.
+func (s *Stream) awaitHandshake() bool {
+	timer := time.NewTimer(handshakeTimeout)
+	defer timer.Stop()
+
 	select {
 	case <-s.handshakeSucceedCh:
-		// handshake succeed.
+		return true
 	case <-s.quitWriteCh:
 		logging.VLog().WithFields(logrus.Fields{
 			"stream": s.String(),
 		}).Debug("Quiting Stream Write Loop.")
-		return
-	case <-handshakeTimeoutTicker.C:
+		return false
+	case <-timer.C:
 		logging.VLog().WithFields(logrus.Fields{
 			"stream": s.String(),
 		}).Debug("Handshaking Stream timeout, quiting.")
-		s.close(errors.New("Handshake timeout"))
+		scoreTrackerFor(s.node).adjust(s.pid, scoreDeltaHandshakeTimeout, "handshake timeout")
+		s.close(newDiscCloseError(DiscHandshakeTimeout, errors.New("handshake timeout")))
+		return false
+	}
+}
+
+func (s *Stream) writeLoop() {
+	if !s.awaitHandshake() {
 		return
 	}
 
@@ -441,6 +740,78 @@ func (s *Stream) writeLoop() {
 	}
 }
 
+// muxWriteLoop waits out the same handshake gate/timeout as the legacy writeLoop, then drains
+// the message channel dedicated to class and writes each message directly to that logical yamux
+// sub-stream, so priority classes and bulk transfers never contend for the same underlying write
+// path.
+func (s *Stream) muxWriteLoop(class int) {
+	if s.mux.subStream(class) == nil {
+		s.close(fmt.Errorf("missing yamux sub-stream: %s", subStreamName(class)))
+		return
+	}
+
+	if !s.awaitHandshake() {
+		return
+	}
+
+	ch := s.channelForClass(class)
+	for {
+		select {
+		case <-s.quitWriteCh:
+			logging.VLog().WithFields(logrus.Fields{
+				"stream": s.String(),
+				"class":  subStreamName(class),
+			}).Debug("Quiting Stream Write Loop.")
+			return
+		case message := <-ch:
+			s.writeNebMessageTo(class, message)
+		}
+	}
+}
+
+// channelForClass returns the outbound message channel backing a logical sub-stream class.
+func (s *Stream) channelForClass(class int) chan *NebMessage {
+	switch class {
+	case subStreamHigh:
+		return s.highPriorityMessageChan
+	case subStreamNormal:
+		return s.normalPriorityMessageChan
+	case subStreamLow:
+		return s.lowPriorityMessageChan
+	default:
+		return s.bulkMessageChan
+	}
+}
+
+// writeNebMessageTo writes message to class's sub-stream via mux.writeTo, mirroring Write()'s
+// deadline and metrics handling for the per-sub-stream mux write path. Going through mux.writeTo
+// (rather than writing the sub-stream directly) keeps this serialized against any synchronous
+// Write() call on the same class, e.g. a Bye sent from the read goroutine while this write loop
+// is mid-drain.
+func (s *Stream) writeNebMessageTo(class int, message *NebMessage) error {
+	metricsPacketsOutByMessageName(message.MessageName(), message.Length())
+
+	data := message.Content()
+	deadline := time.Now().Add(time.Duration(len(data)/1024/5+1) * time.Second)
+
+	n, err := s.mux.writeTo(class, data, deadline)
+	message.FlagWriteMessageAt()
+	if err != nil {
+		logging.VLog().WithFields(logrus.Fields{
+			"err":    err,
+			"stream": s.String(),
+		}).Warn("Failed to send message to peer.")
+		s.close(err)
+		return err
+	}
+	s.latestWriteAt = time.Now().Unix()
+
+	metricsPacketsOut.Mark(1)
+	metricsBytesOut.Mark(int64(n))
+
+	return nil
+}
+
 func (s *Stream) handleMessage(message *NebMessage) error {
 	messageName := message.MessageName()
 	compressFlag := message.Reserved()[0] & 0x80
@@ -455,7 +826,9 @@ func (s *Stream) handleMessage(message *NebMessage) error {
 			var err error
 			data, err = snappy.Decode(nil, message.Data())
 			if err != nil {
-				return ErrUncompressMessageFailed
+				scoreTrackerFor(s.node).adjust(s.pid, scoreDeltaUncompressFail, "uncompress failed")
+				s.pendingDiscReason = DiscSubprotocolError
+				return ErrShouldCloseConnectionAndExitLoop
 			}
 		}
 	}
@@ -471,6 +844,8 @@ func (s *Stream) handleMessage(message *NebMessage) error {
 
 	// check handshake status.
 	if s.status != streamStatusHandshakeSucceed {
+		scoreTrackerFor(s.node).adjust(s.pid, scoreDeltaInvalidProto, "message sent before handshake succeeded")
+		s.pendingDiscReason = DiscProtocolError
 		return ErrShouldCloseConnectionAndExitLoop
 	}
 
@@ -500,17 +875,37 @@ func (s *Stream) close(reason error) {
 	}
 	s.status = streamStatusClosed
 
+	disc := discReasonOf(reason)
+	if shouldRecordBackoffFailure(reason, disc) {
+		backoffTrackerFor(s.node).recordFailure(s.pid)
+	}
+
+	direction := "inbound"
+	if s.outbound {
+		direction = "outbound"
+	}
+
 	logging.VLog().WithFields(logrus.Fields{
-		"stream": s.String(),
-		"reason": reason,
+		"pid":         s.pid.Pretty(),
+		"stream":      s.String(),
+		"err":         reason,
+		"reason":      disc.String(),
+		"reason_code": int(disc),
+		"direction":   direction,
 	}).Debug("Closing stream.")
 
 	// cleanup.
 	s.node.streamManager.RemoveStream(s)
 	s.node.routeTable.RemovePeerStream(s)
 
-	// quit.
-	s.quitWriteCh <- true
+	// quit. closed (rather than sent on) so every write-loop goroutine observes it -- under
+	// muxing there is one per logical sub-stream instead of a single writeLoop.
+	close(s.quitWriteCh)
+
+	// close mux session, if any.
+	if s.mux != nil {
+		s.mux.Close()
+	}
 
 	// close stream.
 	if s.stream != nil {
@@ -518,16 +913,33 @@ func (s *Stream) close(reason error) {
 	}
 }
 
-// Bye say bye in the stream
-func (s *Stream) Bye() {
-	s.WriteMessage(BYE, []byte{})
-	s.close(errors.New("bye: force close"))
+// Bye say bye in the stream, carrying reason as a one-byte payload so the remote end knows why
+// it was disconnected.
+func (s *Stream) Bye(reason DiscReason) {
+	s.WriteMessage(BYE, []byte{byte(reason)})
+	s.close(newDiscCloseError(reason, errors.New("bye")))
 }
 
 func (s *Stream) onBye(message *NebMessage) error {
+	reason := DiscRequested
+	data := message.Data()
+	if message.Reserved()[0]&0x80 > 0 {
+		if decoded, err := snappy.Decode(nil, data); err == nil {
+			data = decoded
+		}
+	}
+	if len(data) > 0 {
+		reason = DiscReason(data[0])
+	}
+
 	logging.VLog().WithFields(logrus.Fields{
-		"stream": s.String(),
-	}).Debug("Received Bye message, close the connection.")
+		"pid":         s.pid.Pretty(),
+		"reason":      reason.String(),
+		"reason_code": int(reason),
+		"direction":   "in",
+	}).Debug("Received Bye message, closing the connection.")
+
+	s.pendingDiscReason = DiscRequested
 	return ErrShouldCloseConnectionAndExitLoop
 }
 
@@ -536,6 +948,7 @@ func (s *Stream) Hello() error {
 	msg := &netpb.Hello{
 		NodeId:        s.node.id.String(),
 		ClientVersion: ClientVersion,
+		Capabilities:  localCapabilities(s.node),
 	}
 	return s.WriteProtoMessage(HELLO, msg)
 }
@@ -543,10 +956,12 @@ func (s *Stream) Hello() error {
 func (s *Stream) onHello(message *NebMessage, data []byte) error {
 	msg, err := netpb.HelloMessageFromProto(data)
 	if err != nil {
+		scoreTrackerFor(s.node).adjust(s.pid, scoreDeltaInvalidProto, "invalid hello proto")
+		s.pendingDiscReason = DiscProtocolError
 		return ErrShouldCloseConnectionAndExitLoop
 	}
 
-	if msg.NodeId != s.pid.String() || !CheckClientVersionCompatibility(ClientVersion, msg.ClientVersion) {
+	if msg.NodeId != s.pid.String() || !CheckClientVersionCompatibility(ClientVersion, msg.ClientVersion, s.node.config.MinCompatibleMinor) {
 		// invalid client, bye().
 		logging.VLog().WithFields(logrus.Fields{
 			"pid":               s.pid.Pretty(),
@@ -554,8 +969,10 @@ func (s *Stream) onHello(message *NebMessage, data []byte) error {
 			"ok.node_id":        msg.NodeId,
 			"ok.client_version": msg.ClientVersion,
 		}).Warn("Invalid NodeId or incompatible client version.")
+		s.pendingDiscReason = DiscIncompatibleVersion
 		return ErrShouldCloseConnectionAndExitLoop
 	}
+	s.storeCapabilities(msg.Capabilities)
 
 	// add to route table.
 	s.node.routeTable.AddPeerStream(s)
@@ -572,6 +989,7 @@ func (s *Stream) Ok() error {
 	resp := &netpb.OK{
 		NodeId:        s.node.id.String(),
 		ClientVersion: ClientVersion,
+		Capabilities:  localCapabilities(s.node),
 	}
 
 	return s.WriteProtoMessage(OK, resp)
@@ -580,10 +998,12 @@ func (s *Stream) Ok() error {
 func (s *Stream) onOk(message *NebMessage, data []byte) error {
 	msg, err := netpb.OKMessageFromProto(data)
 	if err != nil {
+		scoreTrackerFor(s.node).adjust(s.pid, scoreDeltaInvalidProto, "invalid ok proto")
+		s.pendingDiscReason = DiscProtocolError
 		return ErrShouldCloseConnectionAndExitLoop
 	}
 
-	if msg.NodeId != s.pid.String() || !CheckClientVersionCompatibility(ClientVersion, msg.ClientVersion) {
+	if msg.NodeId != s.pid.String() || !CheckClientVersionCompatibility(ClientVersion, msg.ClientVersion, s.node.config.MinCompatibleMinor) {
 		// invalid client, bye().
 		logging.VLog().WithFields(logrus.Fields{
 			"pid":               s.pid.Pretty(),
@@ -591,8 +1011,10 @@ func (s *Stream) onOk(message *NebMessage, data []byte) error {
 			"ok.node_id":        msg.NodeId,
 			"ok.client_version": msg.ClientVersion,
 		}).Warn("Invalid NodeId or incompatible client version.")
+		s.pendingDiscReason = DiscIncompatibleVersion
 		return ErrShouldCloseConnectionAndExitLoop
 	}
+	s.storeCapabilities(msg.Capabilities)
 
 	// add to route table.
 	s.node.routeTable.AddPeerStream(s)
@@ -612,7 +1034,8 @@ func (s *Stream) onSyncRoute(message *NebMessage) error {
 	return s.RouteTable()
 }
 
-// RouteTable send sync table request
+// RouteTable send sync table request. Addrs are forwarded as-is, so circuit-relay multiaddrs
+// (see relay.go) are gossiped across the mesh just like any other peer address.
 func (s *Stream) RouteTable() error {
 	// get random peers from routeTable
 	peers := s.node.routeTable.GetRandomPeers(s.pid)
@@ -647,24 +1070,38 @@ func (s *Stream) onRouteTable(message *NebMessage, data []byte) error {
 		logging.VLog().WithFields(logrus.Fields{
 			"err": err,
 		}).Debug("Invalid Peers proto message.")
+		scoreTrackerFor(s.node).adjust(s.pid, scoreDeltaInvalidProto, "invalid routetable proto")
+		s.pendingDiscReason = DiscProtocolError
 		return ErrShouldCloseConnectionAndExitLoop
 	}
 
 	s.node.routeTable.AddPeers(s.node.ID(), peers)
+	scoreTrackerFor(s.node).adjust(s.pid, scoreDeltaTimelySyncRoute, "answered syncroute request")
 
 	return nil
 }
 
+// storeCapabilities records the capability set the peer advertised in HELLO/OK. Only snappy
+// compression is gated on it (see shouldCompress). Yamux is set up from the negotiated protocol
+// ID before the handshake, so a peer that lacks "mux/1" keeps its mux session and is only logged
+// here; relay use is not gated on "relay/1".
+func (s *Stream) storeCapabilities(capabilities []string) {
+	s.capabilities = newCapabilitySet(capabilities)
+
+	if s.muxEnabled && !s.capabilities.Has(CapabilityMux) {
+		logging.VLog().WithFields(logrus.Fields{
+			"stream": s.String(),
+		}).Debug("Peer negotiated the mux protocol but did not advertise the mux/1 capability.")
+	}
+}
+
 func (s *Stream) finishHandshake() {
 	logging.VLog().WithFields(logrus.Fields{
 		"stream": s.String(),
 	}).Debug("Finished handshake.")
 
 	s.status = streamStatusHandshakeSucceed
-	s.handshakeSucceedCh <- true
-}
-
-// CheckClientVersionCompatibility if two clients are compatible
-func CheckClientVersionCompatibility(v1, v2 string) bool {
-	return v1 == v2
+	close(s.handshakeSucceedCh)
+	backoffTrackerFor(s.node).recordSuccess(s.pid)
+	scoreTrackerFor(s.node).adjust(s.pid, scoreDeltaHandshake, "handshake succeeded")
 }